@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gonutz/normalize/internal/wav"
+)
+
+// albumTrack bundles everything normalizeAlbum needs to remember about one
+// file between its analyze and apply passes.
+type albumTrack struct {
+	path    string
+	wavPath string
+	info    wav.Info
+	probe   probeResult
+	m       measurement
+}
+
+// normalizeAlbum normalizes every file in paths the way ReplayGain's album
+// mode does: each file is measured independently via analyzeWavFile, then a
+// single gain derived from those measurements (see albumScale) is applied
+// to all of them via applyGainToWavFile, so relative loudness differences
+// between tracks survive normalization instead of being flattened out.
+//
+// A file that fails to probe, decode or analyze is logged and excluded from
+// the album, the same way main's per-file worker loop logs and moves on
+// instead of aborting the whole run.
+func normalizeAlbum(paths []string, tempDir string, opts normalizeOptions, parallel int) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	tracks := make([]*albumTrack, len(paths))
+	parallelFor(len(paths), parallel, func(i int) error {
+		path := paths[i]
+		probe, err := probeFile(path)
+		if err != nil {
+			fmt.Println("ERROR", path, err)
+			return nil
+		}
+
+		fileName := filepath.Base(path)
+		wavPath := filepath.Join(tempDir, fileName+".temp.wav")
+		inExt := strings.ToLower(filepath.Ext(path))
+		if err := toWavFile(path, wavPath, inExt, probe); err != nil {
+			fmt.Println("ERROR", path, err)
+			return nil
+		}
+
+		m, info, err := analyzeWavFile(wavPath, opts)
+		if err != nil {
+			os.Remove(wavPath)
+			fmt.Println("ERROR", path, err)
+			return nil
+		}
+
+		tracks[i] = &albumTrack{path: path, wavPath: wavPath, info: info, probe: probe, m: m}
+		return nil
+	})
+
+	scale, ok := albumScale(tracks, opts)
+	if !ok {
+		return nil
+	}
+
+	return parallelFor(len(paths), parallel, func(i int) error {
+		t := tracks[i]
+		if t == nil {
+			return nil
+		}
+		defer os.Remove(t.wavPath)
+
+		changed, err := applyGainToWavFile(t.wavPath, t.info, scale)
+		if err != nil {
+			fmt.Println("ERROR", t.path, err)
+			return nil
+		}
+		if !changed {
+			return nil
+		}
+
+		if err := trimAndPadWavFile(t.wavPath, opts); err != nil {
+			fmt.Println("ERROR", t.path, err)
+			return nil
+		}
+
+		inExt := strings.ToLower(filepath.Ext(t.path))
+		outExt := inExt
+		if opts.outputFormat != "" {
+			outExt = opts.outputFormat
+		}
+		outPath := t.path
+		if outExt != inExt {
+			outPath = strings.TrimSuffix(t.path, filepath.Ext(t.path)) + outExt
+		}
+		if err := wavToOriginalFile(t.wavPath, outPath, outExt, t.probe); err != nil {
+			fmt.Println("ERROR", t.path, err)
+		}
+		return nil
+	})
+}
+
+// albumScale derives the single gain applied to every track in the album
+// from the mean of their individual loudness measurements, the way
+// ReplayGain's album gain does, then clamps it against the highest sample
+// peak among the tracks so no track clips or exceeds opts.peakCeiling. It
+// ignores tracks that failed to analyze (a nil entry in tracks) and reports
+// ok = false if none of them succeeded.
+func albumScale(tracks []*albumTrack, opts normalizeOptions) (scale float64, ok bool) {
+	var sumLoudness float64
+	var maxPeak float64
+	var count int
+	for _, t := range tracks {
+		if t == nil {
+			continue
+		}
+		sumLoudness += t.m.loudness
+		if t.m.peak > maxPeak {
+			maxPeak = t.m.peak
+		}
+		count++
+	}
+	if count == 0 {
+		return 0, false
+	}
+	meanLoudness := sumLoudness / float64(count)
+
+	if opts.mode == "r128" {
+		return r128Scale(meanLoudness, maxPeak, opts.targetLUFS, opts.peakCeiling), true
+	}
+	return avgAmplitudeScale(meanLoudness, maxPeak, opts.scaleFactor), true
+}
+
+// parallelFor calls fn(i) for every i in [0, n) using up to parallel
+// goroutines at a time and returns the first error encountered, the same
+// worker pool pattern main uses to process files concurrently.
+func parallelFor(n, parallel int, fn func(i int) error) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	if parallel > n {
+		parallel = n
+	}
+
+	indices := make(chan int)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	wg.Add(parallel)
+	for w := 0; w < parallel; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				errs <- fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
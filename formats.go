@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// probeResult holds the subset of an input file's stream info, as reported
+// by ffprobe, that decoding and encoding decisions are based on.
+type probeResult struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	BitRate       int
+	Profile       string
+}
+
+// probeFile runs ffprobe on path and extracts the first audio stream's
+// sample rate, channel count, bit depth and bitrate, so the intermediate
+// WAV file can be made to match the source's resolution instead of forcing
+// a fixed 44100 Hz/16 bit downsample.
+func probeFile(path string) (probeResult, error) {
+	out, err := exec.Command(
+		"ffprobe",
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_streams",
+		path,
+	).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return probeResult{}, fmt.Errorf("%s\n", exitErr.Stderr)
+		}
+		return probeResult{}, err
+	}
+
+	var parsed struct {
+		Streams []struct {
+			CodecType        string `json:"codec_type"`
+			SampleRate       string `json:"sample_rate"`
+			Channels         int    `json:"channels"`
+			BitsPerRawSample string `json:"bits_per_raw_sample"`
+			BitRate          string `json:"bit_rate"`
+			Profile          string `json:"profile"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return probeResult{}, err
+	}
+
+	for _, s := range parsed.Streams {
+		if s.CodecType != "audio" {
+			continue
+		}
+		sampleRate, _ := strconv.Atoi(s.SampleRate)
+		bits, _ := strconv.Atoi(s.BitsPerRawSample)
+		bitRate, _ := strconv.Atoi(s.BitRate)
+		return probeResult{
+			SampleRate:    sampleRate,
+			Channels:      s.Channels,
+			BitsPerSample: bits,
+			BitRate:       bitRate,
+			Profile:       s.Profile,
+		}, nil
+	}
+	return probeResult{}, fmt.Errorf("%s: no audio stream found", path)
+}
+
+// format describes how to decode a given container to the intermediate WAV
+// file and how to re-encode the normalized WAV back into that container.
+type format struct {
+	decodeArgs func(probe probeResult) []string
+	encodeArgs func(probe probeResult) []string
+}
+
+// formats maps a lower-case file extension (with leading dot) to the ffmpeg
+// arguments used to decode it to WAV and to re-encode a WAV back into it.
+var formats = map[string]format{
+	".mp3": {
+		decodeArgs: pcmDecodeArgs,
+		encodeArgs: func(probe probeResult) []string {
+			return []string{"-c:a", "libmp3lame"}
+		},
+	},
+	".wav": {
+		decodeArgs: pcmDecodeArgs,
+		encodeArgs: func(probe probeResult) []string {
+			return pcmDecodeArgs(probe)
+		},
+	},
+	".flac": {
+		decodeArgs: pcmDecodeArgs,
+		encodeArgs: func(probe probeResult) []string {
+			return []string{"-c:a", "flac", "-compression_level", "8"}
+		},
+	},
+	".ogg": {
+		decodeArgs: pcmDecodeArgs,
+		encodeArgs: func(probe probeResult) []string {
+			return []string{"-c:a", "libvorbis"}
+		},
+	},
+	".opus": {
+		decodeArgs: pcmDecodeArgs,
+		encodeArgs: func(probe probeResult) []string {
+			args := []string{"-c:a", "libopus"}
+			if probe.BitRate > 0 {
+				args = append(args, "-b:a", strconv.Itoa(probe.BitRate))
+			}
+			return args
+		},
+	},
+	".m4a": {
+		decodeArgs: pcmDecodeArgs,
+		encodeArgs: func(probe probeResult) []string {
+			args := aacEncoderArgs(probe.Profile)
+			if probe.BitRate > 0 {
+				args = append(args, "-b:a", strconv.Itoa(probe.BitRate))
+			}
+			return args
+		},
+	},
+}
+
+// aacEncoderArgs picks the ffmpeg audio encoder and -profile:a value that
+// match the source file's AAC profile, as reported by ffprobe's "profile"
+// field, so an HE-AAC/HE-AACv2 source is not silently re-encoded as plain
+// LC. ffmpeg's built-in "aac" encoder only implements the LC profile, so HE
+// profiles require the libfdk_aac encoder instead; if that encoder is not
+// available in a given ffmpeg build, the encode will fail rather than
+// silently dropping back to LC.
+func aacEncoderArgs(profile string) []string {
+	switch profile {
+	case "HE-AAC":
+		return []string{"-c:a", "libfdk_aac", "-profile:a", "aac_he"}
+	case "HE-AACv2":
+		return []string{"-c:a", "libfdk_aac", "-profile:a", "aac_he_v2"}
+	default:
+		return []string{"-c:a", "aac"}
+	}
+}
+
+// pcmDecodeArgs picks the intermediate WAV's sample format, rate and
+// channel count to match the source file, falling back to the previous
+// fixed 44100 Hz/16 bit/stereo defaults when ffprobe could not tell us.
+func pcmDecodeArgs(probe probeResult) []string {
+	sampleFormat := "pcm_s16le"
+	if probe.BitsPerSample >= 24 {
+		sampleFormat = "pcm_s24le"
+	}
+	sampleRate := "44100"
+	if probe.SampleRate > 0 {
+		sampleRate = strconv.Itoa(probe.SampleRate)
+	}
+	channels := "2"
+	if probe.Channels > 0 {
+		channels = strconv.Itoa(probe.Channels)
+	}
+	return []string{
+		"-c:a", sampleFormat,
+		"-ar", sampleRate,
+		"-ac", channels,
+	}
+}
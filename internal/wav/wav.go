@@ -0,0 +1,246 @@
+// Package wav walks the RIFF/WAVE chunk structure of WAV files and
+// decodes/encodes their PCM/IEEE float samples. It is internal so that
+// main and wavedit share one chunk parser instead of each maintaining its
+// own copy.
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// Format tags found in the fmt chunk's AudioFormat field.
+const (
+	FormatPCM       = 1
+	FormatIEEEFloat = 3
+)
+
+// AudioFormat is the parsed content of a WAV file's fmt chunk.
+type AudioFormat struct {
+	AudioFormat   uint16 // 1 = PCM, 3 = IEEE float.
+	NumChannels   uint16
+	SampleRate    uint32
+	BitsPerSample uint16
+	BlockAlign    uint16
+}
+
+// Info is the result of walking a WAV file's RIFF chunks: the parsed fmt
+// chunk plus the byte range of the data chunk that holds the samples.
+type Info struct {
+	Format     AudioFormat
+	DataOffset int64
+	DataSize   int64
+}
+
+// ReadInfo walks the RIFF/WAVE chunk structure of f, which must be
+// positioned at the start of the file. Chunks other than fmt and data (LIST,
+// bext, JUNK, fact, ...) are skipped over rather than understood, since we
+// only need the sample format and the location of the samples themselves.
+func ReadInfo(f *os.File) (Info, error) {
+	var riffHeader [12]byte
+	if _, err := io.ReadFull(f, riffHeader[:]); err != nil {
+		return Info{}, err
+	}
+	if string(riffHeader[0:4]) != "RIFF" || string(riffHeader[8:12]) != "WAVE" {
+		return Info{}, errors.New("not a RIFF/WAVE file")
+	}
+
+	var info Info
+	haveFormat := false
+	haveData := false
+	for {
+		var chunkHeader [8]byte
+		_, err := io.ReadFull(f, chunkHeader[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Info{}, err
+		}
+		id := string(chunkHeader[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunkHeader[4:8]))
+
+		switch id {
+		case "fmt ":
+			body := make([]byte, size)
+			if _, err := io.ReadFull(f, body); err != nil {
+				return Info{}, err
+			}
+			format, err := parseFmtChunk(body)
+			if err != nil {
+				return Info{}, err
+			}
+			info.Format = format
+			haveFormat = true
+		case "data":
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return Info{}, err
+			}
+			info.DataOffset = offset
+			info.DataSize = size
+			haveData = true
+			if _, err := f.Seek(size, io.SeekCurrent); err != nil {
+				return Info{}, err
+			}
+		default:
+			if _, err := f.Seek(size, io.SeekCurrent); err != nil {
+				return Info{}, err
+			}
+		}
+
+		if size%2 == 1 {
+			// Chunks are padded to an even number of bytes.
+			if _, err := f.Seek(1, io.SeekCurrent); err != nil {
+				return Info{}, err
+			}
+		}
+	}
+
+	if !haveFormat {
+		return Info{}, errors.New("WAV file has no fmt chunk")
+	}
+	if !haveData {
+		return Info{}, errors.New("WAV file has no data chunk")
+	}
+	return info, nil
+}
+
+// ReadInfoSeq walks the RIFF/WAVE chunk structure of r the same way ReadInfo
+// does, but works on a plain, non-seekable io.Reader such as an ffmpeg
+// stdout pipe: unknown chunks are skipped by discarding their bytes instead
+// of seeking past them. It returns the parsed info together with the raw
+// header bytes it consumed (everything up to and including the data
+// chunk's id/size, but none of the sample data itself), so a caller
+// streaming samples elsewhere can replay that header unchanged.
+func ReadInfoSeq(r io.Reader) (Info, []byte, error) {
+	var header bytes.Buffer
+	tr := io.TeeReader(r, &header)
+
+	var riffHeader [12]byte
+	if _, err := io.ReadFull(tr, riffHeader[:]); err != nil {
+		return Info{}, nil, err
+	}
+	if string(riffHeader[0:4]) != "RIFF" || string(riffHeader[8:12]) != "WAVE" {
+		return Info{}, nil, errors.New("not a RIFF/WAVE file")
+	}
+
+	var info Info
+	haveFormat := false
+	for !haveFormat || info.DataSize == 0 {
+		var chunkHeader [8]byte
+		if _, err := io.ReadFull(tr, chunkHeader[:]); err != nil {
+			return Info{}, nil, err
+		}
+		id := string(chunkHeader[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunkHeader[4:8]))
+
+		switch id {
+		case "fmt ":
+			body := make([]byte, size)
+			if _, err := io.ReadFull(tr, body); err != nil {
+				return Info{}, nil, err
+			}
+			format, err := parseFmtChunk(body)
+			if err != nil {
+				return Info{}, nil, err
+			}
+			info.Format = format
+			haveFormat = true
+			if size%2 == 1 {
+				if _, err := io.CopyN(ioutil.Discard, tr, 1); err != nil {
+					return Info{}, nil, err
+				}
+			}
+		case "data":
+			// The data chunk's payload is not part of the header: stop
+			// teeing before reading it, the caller streams it separately.
+			info.DataSize = size
+		default:
+			if _, err := io.CopyN(ioutil.Discard, tr, size); err != nil {
+				return Info{}, nil, err
+			}
+			if size%2 == 1 {
+				if _, err := io.CopyN(ioutil.Discard, tr, 1); err != nil {
+					return Info{}, nil, err
+				}
+			}
+		}
+	}
+
+	if !haveFormat {
+		return Info{}, nil, errors.New("WAV file has no fmt chunk")
+	}
+	return info, header.Bytes(), nil
+}
+
+// parseFmtChunk parses the body of a fmt chunk, which must be at least 16
+// bytes long.
+func parseFmtChunk(body []byte) (AudioFormat, error) {
+	if len(body) < 16 {
+		return AudioFormat{}, errors.New("fmt chunk is too small")
+	}
+	return AudioFormat{
+		AudioFormat:   binary.LittleEndian.Uint16(body[0:2]),
+		NumChannels:   binary.LittleEndian.Uint16(body[2:4]),
+		SampleRate:    binary.LittleEndian.Uint32(body[4:8]),
+		BlockAlign:    binary.LittleEndian.Uint16(body[12:14]),
+		BitsPerSample: binary.LittleEndian.Uint16(body[14:16]),
+	}, nil
+}
+
+// SampleSize returns the number of bytes a single sample of format f takes
+// up, e.g. 2 for 16 bit PCM or 3 for 24 bit PCM.
+func SampleSize(f AudioFormat) int {
+	return int(f.BitsPerSample) / 8
+}
+
+// DecodeSample reads a single sample from buf, which must hold at least
+// SampleSize(f) bytes, and returns it as a float64 normalized to [-1, 1].
+func DecodeSample(buf []byte, f AudioFormat) float64 {
+	switch {
+	case f.AudioFormat == FormatIEEEFloat && f.BitsPerSample == 32:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(buf)))
+	case f.BitsPerSample == 16:
+		return float64(int16(binary.LittleEndian.Uint16(buf))) / 32768.0
+	case f.BitsPerSample == 24:
+		v := int32(buf[0]) | int32(buf[1])<<8 | int32(buf[2])<<16
+		if v&0x800000 != 0 {
+			v -= 0x1000000
+		}
+		return float64(v) / 8388608.0
+	case f.BitsPerSample == 32:
+		return float64(int32(binary.LittleEndian.Uint32(buf))) / 2147483648.0
+	default:
+		return 0
+	}
+}
+
+// EncodeSample writes v, normalized to [-1, 1] and clamped if outside that
+// range, into buf as a sample of format f.
+func EncodeSample(buf []byte, f AudioFormat, v float64) {
+	if v > 1 {
+		v = 1
+	}
+	if v < -1 {
+		v = -1
+	}
+	switch {
+	case f.AudioFormat == FormatIEEEFloat && f.BitsPerSample == 32:
+		binary.LittleEndian.PutUint32(buf, math.Float32bits(float32(v)))
+	case f.BitsPerSample == 16:
+		binary.LittleEndian.PutUint16(buf, uint16(int16(v*32767)))
+	case f.BitsPerSample == 24:
+		i := int32(v * 8388607)
+		buf[0] = byte(i)
+		buf[1] = byte(i >> 8)
+		buf[2] = byte(i >> 16)
+	case f.BitsPerSample == 32:
+		binary.LittleEndian.PutUint32(buf, uint32(int32(v*2147483647)))
+	}
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
-	"encoding/binary"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
+
+	"github.com/gonutz/normalize/internal/wav"
+	"github.com/gonutz/normalize/wavedit"
 )
 
 func main() {
@@ -20,9 +22,10 @@ func main() {
 			`  Usage of %s: first pass the flags you want (see below), then pass
     any number of paths.
   Each path can be either a file which is then normalized or a folder.
-  From each given folder all MP3 files will be normalized.
-  If you pass no path at all, all MP3 files in the current working directory
-    are normalized.
+  From each given folder all supported sound files (mp3, wav, flac, ogg,
+    opus, m4a) will be normalized.
+  If you pass no path at all, all supported sound files in the current
+    working directory are normalized.
 `, os.Args[0])
 		flag.PrintDefaults()
 	}
@@ -37,45 +40,163 @@ func main() {
 		"Processes to start in parallel. Adjust this value so your CPU does "+
 			"not catch fire.",
 	)
+	mode := flag.String(
+		"mode",
+		"avg",
+		"Loudness measurement to use, either \"avg\" for the legacy average "+
+			"absolute amplitude scheme or \"r128\" for EBU R128 / ITU-R BS.1770-4 "+
+			"integrated loudness normalization.",
+	)
+	targetLUFS := flag.Float64(
+		"lufs",
+		-16,
+		"Target integrated loudness in LUFS, only used with -mode=r128.",
+	)
+	peakCeiling := flag.Float64(
+		"peak",
+		-1,
+		"Maximum allowed sample peak in dBTP, only used with -mode=r128. The "+
+			"gain is clamped so the output never exceeds this ceiling.",
+	)
+	forceFormat := flag.String(
+		"format",
+		"",
+		"Force this output format (e.g. \"mp3\", \"flac\") for every file "+
+			"instead of keeping each file's original format.",
+	)
+	stream := flag.Bool(
+		"stream",
+		false,
+		"Pipe samples through ffmpeg's stdin/stdout instead of a temp WAV "+
+			"file on disk. Decodes each file twice but avoids all temp file "+
+			"I/O. With -mode=avg this also keeps memory use bounded to a "+
+			"single buffer regardless of file size; -mode=r128 still holds "+
+			"the whole decoded track in memory to compute its gated "+
+			"loudness, with or without -stream, so it saves disk I/O only.",
+	)
+	album := flag.Bool(
+		"album",
+		false,
+		"Treat all given files as one album: measure each file's loudness "+
+			"independently, then apply the same gain to every file instead "+
+			"of normalizing each one to -lufs on its own, so relative "+
+			"loudness differences between tracks survive normalization.",
+	)
+	albumTargetLUFS := flag.Float64(
+		"target-lufs",
+		-16,
+		"Target integrated loudness in LUFS for the whole album, only used "+
+			"with -album. Analogous to -lufs, but applied once to the album "+
+			"instead of separately to each file.",
+	)
+	albumPeakCeiling := flag.Float64(
+		"peak-ceiling",
+		-1,
+		"Maximum allowed sample peak in dBTP for the album's applied gain, "+
+			"only used with -album. Analogous to -peak.",
+	)
+	trimSilence := flag.Bool(
+		"trim-silence",
+		false,
+		"Trim leading and trailing silence (see -silence-db) after scaling. "+
+			"Not supported together with -stream.",
+	)
+	silenceDB := flag.Float64(
+		"silence-db",
+		-60,
+		"Samples at or below this level (in dBFS) count as silence for "+
+			"-trim-silence, only used with -trim-silence.",
+	)
+	pad := flag.Int(
+		"pad",
+		0,
+		"Add this many milliseconds of silence at both the start and end of "+
+			"each file after scaling, useful for broadcast playout. Not "+
+			"supported together with -stream.",
+	)
 	flag.Parse()
 
+	if *stream && (*trimSilence || *pad != 0) {
+		fmt.Fprintln(os.Stderr, "-trim-silence and -pad are not supported together with -stream")
+		os.Exit(1)
+	}
+
 	// User is expected to pass:
 	// - the path to a single sound file or
-	// - the path to a directory in which all mp3 files will be converted or
-	// - nothing, in this case all mp3 files in the current directory are
-	//   converted.
+	// - the path to a directory in which all supported sound files will be
+	//   converted or
+	// - nothing, in this case all supported sound files in the current
+	//   directory are converted.
 	files, err := readFilesFromArgs(flag.Args())
 	if err != nil {
 		panic(err)
 	}
 
-	var mp3s []string
+	var soundFiles []string
 	for _, file := range files {
-		if strings.HasSuffix(strings.ToLower(file), ".mp3") {
-			mp3s = append(mp3s, file)
+		if isSupportedFormat(file) {
+			soundFiles = append(soundFiles, file)
 		}
 	}
 
+	outputFormat := strings.ToLower(*forceFormat)
+	if outputFormat != "" && !strings.HasPrefix(outputFormat, ".") {
+		outputFormat = "." + outputFormat
+	}
+
 	// We will write WAV files to a temporary folder in the process.
 	tempWavDir, err := ioutil.TempDir("", "normalize")
 	if err != nil {
 		tempWavDir = "."
 	} else {
-		defer os.Remove(tempWavDir)
+		defer os.RemoveAll(tempWavDir)
 	}
 
-	var wg sync.WaitGroup
-	paths := make(chan string)
-
 	n := *parallel
 	if n < 1 {
 		n = 1
 	}
+
+	if *album {
+		err := normalizeAlbum(soundFiles, tempWavDir, normalizeOptions{
+			mode:         *mode,
+			scaleFactor:  float64(*scaleFactor),
+			targetLUFS:   *albumTargetLUFS,
+			peakCeiling:  *albumPeakCeiling,
+			outputFormat: outputFormat,
+			trimSilence:  *trimSilence,
+			silenceDB:    *silenceDB,
+			padMS:        *pad,
+		}, n)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	paths := make(chan string)
+
 	for i := 0; i < n; i++ {
 		go func() {
 			for {
 				path := <-paths
-				err := normalizeFile(path, tempWavDir, float64(*scaleFactor))
+				opts := normalizeOptions{
+					mode:         *mode,
+					scaleFactor:  float64(*scaleFactor),
+					targetLUFS:   *targetLUFS,
+					peakCeiling:  *peakCeiling,
+					outputFormat: outputFormat,
+					trimSilence:  *trimSilence,
+					silenceDB:    *silenceDB,
+					padMS:        *pad,
+				}
+				var err error
+				if *stream {
+					err = normalizeFileStreaming(path, opts)
+				} else {
+					err = normalizeFile(path, tempWavDir, opts)
+				}
 				if err != nil {
 					fmt.Println("ERROR", path, err)
 				}
@@ -85,14 +206,14 @@ func main() {
 	}
 
 	lastMsgLen := 0
-	wg.Add(len(mp3s))
-	for i, mp3 := range mp3s {
-		paths <- mp3
+	wg.Add(len(soundFiles))
+	for i, soundFile := range soundFiles {
+		paths <- soundFile
 		msg := fmt.Sprintf(
 			"%d / %d (%.0f%%)",
 			i+1,
-			len(mp3s),
-			100*float64(i+1)/float64(len(mp3s)),
+			len(soundFiles),
+			100*float64(i+1)/float64(len(soundFiles)),
 		)
 		msg = strings.Repeat("\b", lastMsgLen) + msg
 		fmt.Print(msg)
@@ -123,8 +244,7 @@ func readFilesFromArgs(args []string) ([]string, error) {
 			}
 
 			for _, f := range all {
-				if !f.IsDir() &&
-					strings.HasSuffix(strings.ToLower(f.Name()), ".mp3") {
+				if !f.IsDir() && isSupportedFormat(f.Name()) {
 					files = append(files, filepath.Join(path, f.Name()))
 				}
 			}
@@ -136,22 +256,61 @@ func readFilesFromArgs(args []string) ([]string, error) {
 	return files, nil
 }
 
-func normalizeFile(path, tempDir string, scaleFactor float64) error {
+// isSupportedFormat reports whether name's extension is one we know how to
+// decode to WAV and re-encode, as registered in formats.
+func isSupportedFormat(name string) bool {
+	_, ok := formats[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// normalizeOptions bundles the command line flags that influence how a
+// single file is normalized.
+type normalizeOptions struct {
+	mode         string // "avg" or "r128"
+	scaleFactor  float64
+	targetLUFS   float64
+	peakCeiling  float64
+	outputFormat string // forced output extension (with leading dot), or "" to keep the input's
+	trimSilence  bool
+	silenceDB    float64
+	padMS        int // milliseconds of silence added at both the start and end, or 0
+}
+
+func normalizeFile(path, tempDir string, opts normalizeOptions) error {
+	inExt := strings.ToLower(filepath.Ext(path))
+	outExt := inExt
+	if opts.outputFormat != "" {
+		outExt = opts.outputFormat
+	}
+
+	probe, err := probeFile(path)
+	if err != nil {
+		return err
+	}
+
 	fileName := filepath.Base(path)
 	wavPath := filepath.Join(tempDir, fileName+".temp.wav")
 	defer os.Remove(wavPath)
 
-	if err := toWavFile(path, wavPath); err != nil {
+	if err := toWavFile(path, wavPath, inExt, probe); err != nil {
 		return err
 	}
 
-	changed, err := normalizeWavFile(wavPath, scaleFactor)
+	changed, err := normalizeWavFile(wavPath, opts)
 	if err != nil {
 		return err
 	}
 
 	if changed {
-		if err := wavToOriginalFile(wavPath, path); err != nil {
+		if err := trimAndPadWavFile(wavPath, opts); err != nil {
+			return err
+		}
+
+		outPath := path
+		if outExt != inExt {
+			outPath = strings.TrimSuffix(path, filepath.Ext(path)) + outExt
+		}
+		if err := wavToOriginalFile(wavPath, outPath, outExt, probe); err != nil {
 			return err
 		}
 	}
@@ -159,19 +318,41 @@ func normalizeFile(path, tempDir string, scaleFactor float64) error {
 	return nil
 }
 
-func toWavFile(path, wavPath string) error {
-	return runFFMPEG(exec.Command(
+// trimAndPadWavFile applies opts.trimSilence and opts.padMS to wavPath, in
+// that order, after scaling but before the file is re-encoded back to its
+// original format.
+func trimAndPadWavFile(wavPath string, opts normalizeOptions) error {
+	if opts.trimSilence {
+		if err := wavedit.TrimSilence(wavPath, opts.silenceDB); err != nil {
+			return err
+		}
+	}
+	if opts.padMS > 0 {
+		if err := wavedit.PadSilence(wavPath, opts.padMS, opts.padMS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toWavFile(path, wavPath, ext string, probe probeResult) error {
+	fm, ok := formats[ext]
+	if !ok {
+		return fmt.Errorf("%s: unsupported input format %q", path, ext)
+	}
+
+	args := []string{
 		"ffmpeg",   // We let ffmpeg handle our decoding and conversion.
 		"-y",       // Overwrite file if it exists.
 		"-i", path, // Input file.
 		"-bitexact",           // No extra headers in the wav.
 		"-map_metadata", "-1", // Strip metadata (artist, track number, etc.).
 		"-f", "wav", // Format as wav.
-		"-c:a", "pcm_s16le", // Use int16 samples.
-		"-ar", "44100", // Sample rate of 44100 Hz.
-		"-ac", "2", // 2 channels.
-		wavPath, // Write wav data to file.
-	))
+	}
+	args = append(args, fm.decodeArgs(probe)...)
+	args = append(args, wavPath) // Write wav data to file.
+
+	return runFFMPEG(exec.Command(args[0], args[1:]...))
 }
 
 func runFFMPEG(cmd *exec.Cmd) error {
@@ -189,117 +370,401 @@ func runFFMPEG(cmd *exec.Cmd) error {
 	return nil
 }
 
-func normalizeWavFile(wavPath string, scaleFactor float64) (bool, error) {
+// measurement is a file's raw loudness measurement, taken once by
+// analyzeWavFile. It is turned into a scale factor either standalone, by
+// scale, or as part of an album-wide gain, by albumScale.
+type measurement struct {
+	mode     string  // "avg" or "r128", matching normalizeOptions.mode.
+	loudness float64 // Integrated LUFS for "r128", reciprocal of the average amplitude for "avg".
+	peak     float64 // Sample peak in [0, 1], used to avoid clipping.
+}
+
+// scale turns m into the gain normalizeWavFile would apply if this file was
+// normalized on its own, using opts' target/scale and peak settings.
+func (m measurement) scale(opts normalizeOptions) float64 {
+	if m.mode == "r128" {
+		return r128Scale(m.loudness, m.peak, opts.targetLUFS, opts.peakCeiling)
+	}
+	return avgAmplitudeScale(m.loudness, m.peak, opts.scaleFactor)
+}
+
+// analyzeWavFile opens wavPath read-only and measures its loudness according
+// to opts.mode, without modifying the file. It also returns the parsed
+// wav.Info so a later applyGainToWavFile call does not need to re-parse the
+// file's chunks.
+func analyzeWavFile(wavPath string, opts normalizeOptions) (measurement, wav.Info, error) {
+	f, err := os.Open(wavPath)
+	if err != nil {
+		return measurement{}, wav.Info{}, err
+	}
+	defer f.Close()
+
+	info, err := wav.ReadInfo(f)
+	if err != nil {
+		return measurement{}, wav.Info{}, err
+	}
+	if _, err := f.Seek(info.DataOffset, io.SeekStart); err != nil {
+		return measurement{}, wav.Info{}, err
+	}
+
+	m := measurement{mode: opts.mode}
+	switch opts.mode {
+	case "r128":
+		m.loudness, m.peak, err = measureR128(f, info.DataSize, info.Format)
+	default:
+		m.loudness, m.peak, err = measureAvgAmplitude(f, info.DataSize, info.Format)
+	}
+	if err != nil {
+		return measurement{}, wav.Info{}, err
+	}
+	return m, info, nil
+}
+
+// applyGainToWavFile opens wavPath read-write and scales every sample in its
+// data chunk, as described by info, by scale, decoding/encoding each sample
+// through a float64 intermediate so this works for any bit depth or sample
+// type.
+func applyGainToWavFile(wavPath string, info wav.Info, scale float64) (bool, error) {
 	f, err := os.OpenFile(wavPath, os.O_RDWR, 0666)
 	if err != nil {
 		return false, err
 	}
 	defer f.Close()
 
-	// In a WAV file without any meta data the int16 sample stream start at byte
-	// 44, after the RIFF header and the data header.
-	// We read all int16 samples from the file, assuming that the whole rest of
-	// the file contains only samples (i.e. that the data chunk is the last
-	// chunk in the file).
-	// We go over the file in two passes:
-	// 1. Sum up the samples to build the average of all absolute sample 4
-	//    amplitudes. This gives us the appropriate scale factor.
-	// 2. Update all samples in the file with the scale factor.
-	f.Seek(44, io.SeekStart)
+	sz := wav.SampleSize(info.Format)
+	buf := make([]byte, alignedBufSize(sz))
+	if _, err := f.Seek(info.DataOffset, io.SeekStart); err != nil {
+		return false, err
+	}
+	remaining := info.DataSize
+	for remaining > 0 {
+		n := int64(len(buf))
+		if remaining < n {
+			n = remaining
+		}
+		chunk := buf[:n]
+		if _, err := io.ReadFull(f, chunk); err != nil {
+			return false, err
+		}
+		for i := 0; i+sz <= len(chunk); i += sz {
+			sample := wav.DecodeSample(chunk[i:i+sz], info.Format) * scale
+			wav.EncodeSample(chunk[i:i+sz], info.Format, sample)
+		}
+
+		if _, err := f.Seek(-n, io.SeekCurrent); err != nil {
+			return false, err
+		}
+		if _, err := f.Write(chunk); err != nil {
+			return false, err
+		}
+		remaining -= n
+	}
+	return true, nil
+}
+
+// normalizeWavFile measures wavPath's loudness and rewrites its samples with
+// the resulting gain in one step, for the common case of normalizing a file
+// on its own rather than as part of an album (see normalizeAlbum).
+func normalizeWavFile(wavPath string, opts normalizeOptions) (bool, error) {
+	m, info, err := analyzeWavFile(wavPath, opts)
+	if err != nil {
+		return false, err
+	}
+	return applyGainToWavFile(wavPath, info, m.scale(opts))
+}
+
+// alignedBufSize returns an I/O buffer size close to 4096 bytes that is an
+// exact multiple of sz, the size of a single sample, so a read/write never
+// splits a sample across two buffers.
+func alignedBufSize(sz int) int {
+	n := 4096 / sz * sz
+	if n == 0 {
+		n = sz
+	}
+	return n
+}
+
+// measureAvgAmplitude sums the absolute value of every sample (scaled back
+// up to 16 bit range so the -ampl flag keeps its meaning regardless of the
+// file's actual bit depth) and returns the reciprocal of the file's average
+// amplitude (sample count divided by that sum) together with its sample
+// peak in [0, 1]. r must be positioned at the
+// start of size bytes of samples in the given format; r can be a plain file
+// or a streamed ffmpeg pipe.
+func measureAvgAmplitude(r io.Reader, size int64, format wav.AudioFormat) (avg, peak float64, err error) {
+	sz := wav.SampleSize(format)
+	buf := make([]byte, alignedBufSize(sz))
 	var (
-		buf   [4096]byte
-		sum   uint64
-		min   int16
-		max   int16
-		count int
+		sum       uint64
+		count     int
+		remaining = size
 	)
-	for {
-		n, err := f.Read(buf[:])
-		if n%2 == 1 {
-			return false,
-				errors.New("read odd number of bytes in int16 sample stream")
+	for remaining > 0 {
+		n := int64(len(buf))
+		if remaining < n {
+			n = remaining
+		}
+		chunk := buf[:n]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return 0, 0, err
 		}
-		for i := 0; i < n; i += 2 {
-			sample := int16(binary.LittleEndian.Uint16(buf[i:]))
-			// We sum the absolute values of the samples.
-			if sample < 0 {
-				sum += uint64(-sample)
+		for i := 0; i+sz <= len(chunk); i += sz {
+			v := wav.DecodeSample(chunk[i:i+sz], format)
+			amp := v * 32768
+			if amp < 0 {
+				sum += uint64(-amp)
 			} else {
-				sum += uint64(sample)
+				sum += uint64(amp)
 			}
-			if sample < min {
-				min = sample
-			}
-			if sample > max {
-				max = sample
+			if a := math.Abs(v); a > peak {
+				peak = a
 			}
 			count++
 		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return false, err
-		}
+		remaining -= n
 	}
+	return float64(count) / float64(sum), peak, nil
+}
 
-	// The scale is computed from the average amplitude of the WAV file. Also we
-	// do not allow clipping, i.e. we do not scale to more than a 16 bit in can
-	// hold.
-	avg := float64(count) / float64(sum)
-	if -min > max {
-		max = -min
+// avgAmplitudeScale implements the legacy normalization scheme: it derives a
+// scale factor from avg, the reciprocal of the average amplitude measured
+// by measureAvgAmplitude, clamped via peak so that no sample is scaled past its
+// format's full range, i.e. we do not allow clipping.
+func avgAmplitudeScale(avg, peak, scaleFactor float64) float64 {
+	maxScale := 1.0
+	if peak > 0 {
+		maxScale = 1.0 / peak
 	}
-	maxScale := 32767.0 / float64(max)
 	scale := scaleFactor * avg
 	if scale > maxScale {
 		scale = maxScale
 	}
+	return scale
+}
 
-	// Now we skip back to the start and overwrite the file with the scaled
-	// samples.
-	_, err = f.Seek(44, io.SeekStart)
-	if err != nil {
-		return false, err
+// biquad is a 2nd order IIR filter section as used by the BS.1770 K-weighting
+// pre-filters, in direct form I.
+type biquad struct {
+	b0, b1, b2 float64
+	a1, a2     float64
+	x1, x2     float64
+	y1, y2     float64
+}
+
+func (b *biquad) step(x float64) float64 {
+	y := b.b0*x + b.b1*b.x1 + b.b2*b.x2 - b.a1*b.y1 - b.a2*b.y2
+	b.x2, b.x1 = b.x1, x
+	b.y2, b.y1 = b.y1, y
+	return y
+}
+
+// kWeightingFilters derives the pair of biquads (high shelf, then high pass)
+// that make up the BS.1770-4 K-weighting curve for sampleRate, using the
+// bilinear-transform formulas from BS.1770-4 Annex 1. The standard's own
+// coefficient tables are given only for a 48000 Hz design frequency; at
+// sampleRate == 48000 these formulas reduce to those exact published
+// coefficients, and at other rates (e.g. the 44100 Hz most MP3s decode to)
+// they keep the shelf/high-pass corner frequencies correct instead of
+// reusing the 48kHz numbers unmodified.
+func kWeightingFilters(sampleRate float64) (shelf, highPass biquad) {
+	shelf = highShelf(1681.9744509555319, 3.99984385397, 0.7071752369554193, sampleRate)
+	highPass = highpassFilter(38.13547087602444, 0.5003270373238773, sampleRate)
+	return shelf, highPass
+}
+
+// highShelf derives the BS.1770 pre-filter (stage 1) biquad at corner
+// frequency f0, gain gainDB and Q, via the bilinear transform, for
+// sampleRate.
+func highShelf(f0, gainDB, q, sampleRate float64) biquad {
+	k := math.Tan(math.Pi * f0 / sampleRate)
+	vh := math.Pow(10, gainDB/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+
+	a0 := 1.0 + k/q + k*k
+	return biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
 	}
-	done := false
-	for !done {
-		n, err := f.Read(buf[:])
-		done = err == io.EOF
-		if !done && err != nil {
-			return false, err
+}
+
+// highpassFilter derives the BS.1770 RLB weighting curve (stage 2) biquad at
+// corner frequency f0 and Q, via the bilinear transform, for sampleRate.
+func highpassFilter(f0, q, sampleRate float64) biquad {
+	k := math.Tan(math.Pi * f0 / sampleRate)
+	a0 := 1.0 + k/q + k*k
+	return biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+}
+
+// channelWeights returns the BS.1770 channel weight used when summing each
+// channel's mean square energy, indexed by channel position. L/R/C use 1.0,
+// surround Ls/Rs use 1.41, and LFE is excluded (weight 0) as the standard
+// requires. Position is inferred from the WAVE default speaker order for
+// the channel counts that order defines (1, 2 and 5.1's 6); any other
+// channel count falls back to weighting every channel 1.0, since the WAV
+// files this program reads don't carry an explicit channel mask to derive
+// positions from.
+func channelWeights(channels int) []float64 {
+	switch channels {
+	case 6: // 5.1: FL, FR, FC, LFE, BL, BR.
+		return []float64{1.0, 1.0, 1.0, 0, 1.41, 1.41}
+	default:
+		w := make([]float64, channels)
+		for i := range w {
+			w[i] = 1.0
 		}
-		if n%2 == 1 {
-			return false,
-				errors.New("read odd number of bytes in int16 sample stream")
+		return w
+	}
+}
+
+// measureR128 measures the integrated loudness of the samples read from r
+// using EBU R128 / ITU-R BS.1770-4 and returns it in LUFS together with the
+// sample peak in [0, 1]. r must be positioned at the start of size bytes of
+// samples in the given format; r can be a plain file or a streamed ffmpeg
+// pipe.
+func measureR128(r io.Reader, size int64, format wav.AudioFormat) (integratedLUFS, peak float64, err error) {
+	sz := wav.SampleSize(format)
+	channels := int(format.NumChannels)
+	if channels == 0 {
+		channels = 1
+	}
+	frameSize := sz * channels
+	frames := int(size) / frameSize
+	blockSamples := int(0.4 * float64(format.SampleRate))
+	hopSamples := blockSamples / 4 // 75% overlap.
+
+	shelves := make([]biquad, channels)
+	highPasses := make([]biquad, channels)
+	for c := range shelves {
+		shelves[c], highPasses[c] = kWeightingFilters(float64(format.SampleRate))
+	}
+	weights := channelWeights(channels)
+
+	buf := make([]byte, frameSize)
+	filtered := make([][]float64, frames)
+	for i := 0; i < frames; i++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, 0, err
 		}
-		for i := 0; i < n; i += 2 {
-			sample := int16(binary.LittleEndian.Uint16(buf[i:]))
-			if sample < 0 {
-				sample = int16(float64(sample)*scale - 0.5)
-			} else {
-				sample = int16(float64(sample)*scale + 0.5)
+		frame := make([]float64, channels)
+		for c := 0; c < channels; c++ {
+			v := wav.DecodeSample(buf[c*sz:(c+1)*sz], format)
+			if a := math.Abs(v); a > peak {
+				peak = a
 			}
-			binary.LittleEndian.PutUint16(buf[i:], uint16(sample))
+			frame[c] = highPasses[c].step(shelves[c].step(v))
 		}
+		filtered[i] = frame
+	}
 
-		_, err = f.Seek(int64(-n), io.SeekCurrent)
-		if err != nil {
-			return false, err
+	var blockLoudness []float64
+	for start := 0; start == 0 || start+blockSamples <= frames; start += hopSamples {
+		end := start + blockSamples
+		if end > frames {
+			end = frames
 		}
-		_, err = f.Write(buf[:n])
-		if err != nil {
-			return false, err
+		if end <= start {
+			break
+		}
+		ms := make([]float64, channels)
+		for i := start; i < end; i++ {
+			for c := 0; c < channels; c++ {
+				ms[c] += filtered[i][c] * filtered[i][c]
+			}
+		}
+		n := float64(end - start)
+		var weighted float64
+		for c := 0; c < channels; c++ {
+			weighted += weights[c] * (ms[c] / n)
+		}
+		blockLoudness = append(blockLoudness, -0.691+10*math.Log10(weighted))
+		if end == frames {
+			break
 		}
 	}
-	return true, nil
+
+	return gatedMean(blockLoudness), peak, nil
+}
+
+// r128Scale turns an integrated loudness measurement in LUFS, as returned by
+// measureR128, into the linear gain needed to reach targetLUFS, clamped via
+// peak so the true peak of the output stays at or below peakCeilingDBTP. The
+// peak clamp approximates true peak with the sample peak measured by
+// measureR128; a real 4x oversampling FIR would catch inter-sample peaks as
+// well.
+func r128Scale(integratedLUFS, peak, targetLUFS, peakCeilingDBTP float64) float64 {
+	gain := dbToLinear(targetLUFS - integratedLUFS)
+	if peak > 0 {
+		maxGainForPeak := dbToLinear(peakCeilingDBTP) / peak
+		if gain > maxGainForPeak {
+			gain = maxGainForPeak
+		}
+	}
+	return gain
+}
+
+// gatedMean implements the BS.1770 two-stage gating: blocks below -70 LUFS
+// absolute are dropped, then blocks more than 10 LU below the mean of the
+// surviving blocks are dropped too, and the result is averaged again to
+// yield the integrated loudness.
+func gatedMean(blockLoudness []float64) float64 {
+	const absoluteThreshold = -70.0
+	var above []float64
+	for _, l := range blockLoudness {
+		if l >= absoluteThreshold {
+			above = append(above, l)
+		}
+	}
+	if len(above) == 0 {
+		return absoluteThreshold
+	}
+
+	var sum float64
+	for _, l := range above {
+		sum += l
+	}
+	mean := sum / float64(len(above))
+	relativeThreshold := mean - 10.0
+
+	var sum2 float64
+	var count2 int
+	for _, l := range above {
+		if l >= relativeThreshold {
+			sum2 += l
+			count2++
+		}
+	}
+	if count2 == 0 {
+		return mean
+	}
+	return sum2 / float64(count2)
+}
+
+func dbToLinear(db float64) float64 {
+	return math.Pow(10, db/20)
 }
 
-func wavToOriginalFile(wavPath, path string) error {
-	return runFFMPEG(exec.Command(
+func wavToOriginalFile(wavPath, path, ext string, probe probeResult) error {
+	fm, ok := formats[ext]
+	if !ok {
+		return fmt.Errorf("%s: unsupported output format %q", path, ext)
+	}
+
+	args := []string{
 		"ffmpeg",      // We let ffmpeg handle our decoding and conversion.
 		"-y",          // Overwrite file if it exists.
 		"-i", wavPath, // Input file.
-		path, // Output file.
-	))
+	}
+	args = append(args, fm.encodeArgs(probe)...)
+	args = append(args, path) // Output file.
+
+	return runFFMPEG(exec.Command(args[0], args[1:]...))
 }
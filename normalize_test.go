@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/cmplx"
+	"testing"
+
+	"github.com/gonutz/normalize/internal/wav"
+)
+
+// synthesizeSine returns frames samples of 16 bit PCM mono audio at
+// sampleRate Hz containing a sine wave of the given frequency (Hz) and
+// amplitude (linear, 0 to 1).
+func synthesizeSine(sampleRate int, frequency, amplitude float64, frames int) []byte {
+	buf := make([]byte, frames*2)
+	for i := 0; i < frames; i++ {
+		v := amplitude * math.Sin(2*math.Pi*frequency*float64(i)/float64(sampleRate))
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(int16(v*32767)))
+	}
+	return buf
+}
+
+// TestMeasureR128AmplitudeDifference checks that halving a sine tone's
+// amplitude lowers its measured integrated loudness by the matching number
+// of dB, independent of the K-weighting filters' exact gain at the tone's
+// frequency.
+func TestMeasureR128AmplitudeDifference(t *testing.T) {
+	format := wav.AudioFormat{AudioFormat: wav.FormatPCM, NumChannels: 1, SampleRate: 44100, BitsPerSample: 16}
+	const frames = 44100 * 2 // 2 s, enough for several gated 400 ms blocks.
+
+	loud := synthesizeSine(44100, 997, 1.0, frames)
+	quiet := synthesizeSine(44100, 997, 0.25, frames)
+
+	loudLUFS, _, err := measureR128(bytes.NewReader(loud), int64(len(loud)), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quietLUFS, _, err := measureR128(bytes.NewReader(quiet), int64(len(quiet)), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotDiff := loudLUFS - quietLUFS
+	wantDiff := 20 * math.Log10(4) // amplitude ratio of 4 is ~12.04 dB.
+	if math.Abs(gotDiff-wantDiff) > 0.1 {
+		t.Errorf("loudness difference = %.3f dB, want %.3f dB", gotDiff, wantDiff)
+	}
+}
+
+// TestMeasureR128AbsoluteCalibration checks measureR128 against a sine tone
+// at a known dBFS. 997 Hz is the frequency ITU-R BS.1770 conformance tests
+// use: the K-weighting filters have about +0.691 dB gain there, which the
+// formula's -0.691 offset cancels, so a sine at X dBFS should measure close
+// to X - 3.01 LUFS (its unweighted mean square in dB).
+func TestMeasureR128AbsoluteCalibration(t *testing.T) {
+	format := wav.AudioFormat{AudioFormat: wav.FormatPCM, NumChannels: 1, SampleRate: 44100, BitsPerSample: 16}
+	const frames = 44100 * 2
+	const amplitudeDBFS = -20.0
+	amplitude := math.Pow(10, amplitudeDBFS/20)
+	samples := synthesizeSine(44100, 997, amplitude, frames)
+
+	lufs, _, err := measureR128(bytes.NewReader(samples), int64(len(samples)), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := 10 * math.Log10(amplitude*amplitude/2)
+	if math.Abs(lufs-want) > 1.0 {
+		t.Errorf("integrated loudness = %.3f LUFS, want ~%.3f LUFS", lufs, want)
+	}
+}
+
+// kWeightingGainDB independently computes the BS.1770 K-weighting filter
+// pair's magnitude response at frequencyHz for sampleRate, straight from the
+// bilinear-transform formulas in BS.1770-4 Annex 1 (not by calling the
+// production kWeightingFilters, so this can't pass just because it shares a
+// bug with it). It's used to predict how much two measured tones should
+// differ in loudness once the K-weighting shelf/high-pass curve is applied.
+func kWeightingGainDB(frequencyHz, sampleRate float64) float64 {
+	biquadGain := func(f0, gainDB, q float64, highShelf bool) float64 {
+		k := math.Tan(math.Pi * f0 / sampleRate)
+		a0 := 1.0 + k/q + k*k
+		var b0, b1, b2 float64
+		if highShelf {
+			vh := math.Pow(10, gainDB/20)
+			vb := math.Pow(vh, 0.4996667741545416)
+			b0, b1, b2 = (vh+vb*k/q+k*k)/a0, 2*(k*k-vh)/a0, (vh-vb*k/q+k*k)/a0
+		} else {
+			b0, b1, b2 = 1/a0, -2/a0, 1/a0
+		}
+		a1, a2 := 2*(k*k-1)/a0, (1-k/q+k*k)/a0
+
+		w := 2 * math.Pi * frequencyHz / sampleRate
+		z1 := cmplx.Exp(complex(0, -w))
+		z2 := cmplx.Exp(complex(0, -2*w))
+		num := complex(b0, 0) + complex(b1, 0)*z1 + complex(b2, 0)*z2
+		den := complex(1, 0) + complex(a1, 0)*z1 + complex(a2, 0)*z2
+		return cmplx.Abs(num / den)
+	}
+
+	shelfGain := biquadGain(1681.9744509555319, 3.99984385397, 0.7071752369554193, true)
+	highPassGain := biquadGain(38.13547087602444, 0, 0.5003270373238773, false)
+	return 20 * math.Log10(shelfGain*highPassGain)
+}
+
+// TestMeasureR128FrequencyResponse checks measured loudness against the
+// analytic K-weighting response (see kWeightingGainDB) at two frequencies
+// where that curve differs substantially: 20 Hz, well below the RLB
+// high-pass corner, and 8000 Hz, on the high shelf's boosted plateau. 997 Hz
+// alone (as used by TestMeasureR128AbsoluteCalibration) can't catch a wrong
+// filter corner frequency, because the curve's gain there (about +0.7 dB)
+// changes by only about 0.2 dB with the sample rate it was designed for;
+// this one can,
+// because reusing the 48000 Hz filter coefficients unmodified at 44100 Hz
+// shifts both corners enough to change this difference by about 1.1 dB,
+// well outside this test's 0.5 dB tolerance.
+func TestMeasureR128FrequencyResponse(t *testing.T) {
+	const sampleRate = 44100
+	format := wav.AudioFormat{AudioFormat: wav.FormatPCM, NumChannels: 1, SampleRate: sampleRate, BitsPerSample: 16}
+	const frames = sampleRate * 2
+	const amplitude = 0.5
+
+	low := synthesizeSine(sampleRate, 20, amplitude, frames)
+	high := synthesizeSine(sampleRate, 8000, amplitude, frames)
+
+	lowLUFS, _, err := measureR128(bytes.NewReader(low), int64(len(low)), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	highLUFS, _, err := measureR128(bytes.NewReader(high), int64(len(high)), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotDiff := highLUFS - lowLUFS
+	wantDiff := kWeightingGainDB(8000, sampleRate) - kWeightingGainDB(20, sampleRate)
+	if math.Abs(gotDiff-wantDiff) > 0.5 {
+		t.Errorf("loudness difference between 8000 Hz and 20 Hz tones = %.3f dB, want %.3f dB (the K-weighting curve's corner frequencies must track the sample rate)", gotDiff, wantDiff)
+	}
+}
+
+// TestR128ScaleReachesTarget checks that the gain r128Scale derives from a
+// measured loudness, applied to that same measurement, reaches targetLUFS
+// exactly when not clamped by the peak ceiling.
+func TestR128ScaleReachesTarget(t *testing.T) {
+	const measuredLUFS = -30.0
+	const targetLUFS = -16.0
+	const peak = 0.1 // Far from peakCeilingDBTP, so the gain is not clamped.
+
+	gain := r128Scale(measuredLUFS, peak, targetLUFS, -1)
+	gotLUFS := measuredLUFS + 20*math.Log10(gain)
+	if math.Abs(gotLUFS-targetLUFS) > 0.01 {
+		t.Errorf("applying r128Scale's gain reaches %.3f LUFS, want %.3f LUFS", gotLUFS, targetLUFS)
+	}
+}
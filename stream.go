@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gonutz/normalize/internal/wav"
+)
+
+// normalizeFileStreaming is the -stream counterpart to normalizeFile: it
+// gets the same result without ever writing the intermediate WAV to disk.
+// ffmpeg is invoked twice, once to measure the scale and once to apply it,
+// with samples flowing through cmd.StdoutPipe()/cmd.StdinPipe() instead of
+// a temp file. This costs a second decode of the source but saves the disk
+// I/O of the temp WAV round-trip.
+func normalizeFileStreaming(path string, opts normalizeOptions) error {
+	inExt := strings.ToLower(filepath.Ext(path))
+	outExt := inExt
+	if opts.outputFormat != "" {
+		outExt = opts.outputFormat
+	}
+
+	probe, err := probeFile(path)
+	if err != nil {
+		return err
+	}
+
+	scale, err := measureStreamScale(path, inExt, probe, opts)
+	if err != nil {
+		return err
+	}
+
+	outPath := path
+	if outExt != inExt {
+		outPath = strings.TrimSuffix(path, filepath.Ext(path)) + outExt
+	}
+	return applyStreamScale(path, outPath, inExt, outExt, probe, scale)
+}
+
+// measureStreamScale decodes path to WAV via a piped ffmpeg process and
+// measures the gain to apply, without ever touching disk.
+func measureStreamScale(path, ext string, probe probeResult, opts normalizeOptions) (float64, error) {
+	decodeCmd, err := decodeToWavCmd(path, ext, probe)
+	if err != nil {
+		return 0, err
+	}
+	stdout, err := decodeCmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := decodeCmd.Start(); err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(stdout)
+	info, _, err := wav.ReadInfoSeq(r)
+	if err != nil {
+		waitAll(decodeCmd)
+		return 0, err
+	}
+
+	m := measurement{mode: opts.mode}
+	switch opts.mode {
+	case "r128":
+		m.loudness, m.peak, err = measureR128(r, info.DataSize, info.Format)
+	default:
+		m.loudness, m.peak, err = measureAvgAmplitude(r, info.DataSize, info.Format)
+	}
+
+	if waitErr := waitAll(decodeCmd); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return m.scale(opts), nil
+}
+
+// applyStreamScale re-decodes path, scales every sample by scale and
+// streams the result straight into the ffmpeg process that encodes outPath,
+// without an intermediate file on disk.
+func applyStreamScale(path, outPath, inExt, outExt string, probe probeResult, scale float64) error {
+	decodeCmd, err := decodeToWavCmd(path, inExt, probe)
+	if err != nil {
+		return err
+	}
+	stdout, err := decodeCmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	encodeCmd, err := encodeFromWavCmd(outPath, outExt, probe)
+	if err != nil {
+		return err
+	}
+	stdin, err := encodeCmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := decodeCmd.Start(); err != nil {
+		return err
+	}
+	if err := encodeCmd.Start(); err != nil {
+		waitAll(decodeCmd)
+		return err
+	}
+
+	r := bufio.NewReader(stdout)
+	info, header, err := wav.ReadInfoSeq(r)
+	if err == nil {
+		if _, werr := stdin.Write(header); werr != nil {
+			err = werr
+		}
+	}
+	if err == nil {
+		err = copyScaledSamples(stdin, r, info.DataSize, info.Format, scale)
+	}
+	stdin.Close()
+
+	if waitErr := waitAll(decodeCmd, encodeCmd); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// copyScaledSamples reads size bytes of samples of the given format from r,
+// multiplies each by scale and writes the result to w, using a float64
+// intermediate the same way the on-disk pipeline does.
+func copyScaledSamples(w io.Writer, r io.Reader, size int64, format wav.AudioFormat, scale float64) error {
+	sz := wav.SampleSize(format)
+	buf := make([]byte, alignedBufSize(sz))
+	remaining := size
+	for remaining > 0 {
+		n := int64(len(buf))
+		if remaining < n {
+			n = remaining
+		}
+		chunk := buf[:n]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return err
+		}
+		for i := 0; i+sz <= len(chunk); i += sz {
+			sample := wav.DecodeSample(chunk[i:i+sz], format) * scale
+			wav.EncodeSample(chunk[i:i+sz], format, sample)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+	return nil
+}
+
+// decodeToWavCmd builds the ffmpeg command that decodes path to a WAV
+// stream on stdout, using the same arguments as toWavFile but writing to
+// "-" instead of a file.
+func decodeToWavCmd(path, ext string, probe probeResult) (*exec.Cmd, error) {
+	fm, ok := formats[ext]
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported input format %q", path, ext)
+	}
+	args := []string{
+		"-y",
+		"-i", path,
+		"-bitexact",
+		"-map_metadata", "-1",
+		"-f", "wav",
+	}
+	args = append(args, fm.decodeArgs(probe)...)
+	args = append(args, "-")
+
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stderr = &bytes.Buffer{}
+	return cmd, nil
+}
+
+// encodeFromWavCmd builds the ffmpeg command that reads a WAV stream from
+// stdin and encodes it to outPath, using the same arguments as
+// wavToOriginalFile but reading from "-" instead of a file.
+func encodeFromWavCmd(outPath, ext string, probe probeResult) (*exec.Cmd, error) {
+	fm, ok := formats[ext]
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported output format %q", outPath, ext)
+	}
+	args := []string{
+		"-y",
+		"-i", "-",
+	}
+	args = append(args, fm.encodeArgs(probe)...)
+	args = append(args, outPath)
+
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stderr = &bytes.Buffer{}
+	return cmd, nil
+}
+
+// waitAll waits for every cmd to exit concurrently and returns the first
+// error encountered, preferring whatever each process wrote to stderr (set
+// up as a *bytes.Buffer by decodeToWavCmd/encodeFromWavCmd) over the bare
+// "exit status 1" exec.Cmd.Wait() would otherwise return.
+func waitAll(cmds ...*exec.Cmd) error {
+	errs := make([]error, len(cmds))
+	var wg sync.WaitGroup
+	wg.Add(len(cmds))
+	for i, cmd := range cmds {
+		go func(i int, cmd *exec.Cmd) {
+			defer wg.Done()
+			err := cmd.Wait()
+			if err == nil {
+				return
+			}
+			if stderr, ok := cmd.Stderr.(*bytes.Buffer); ok && stderr.Len() > 0 {
+				err = fmt.Errorf("%s\n", stderr.Bytes())
+			}
+			errs[i] = err
+		}(i, cmd)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// Package wavedit trims silence from, and adds silence to, the data chunk
+// of PCM/IEEE float WAV files in place. It has no dependency on the
+// normalize CLI so other tools can reuse it on its own.
+package wavedit
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+
+	"github.com/gonutz/normalize/internal/wav"
+)
+
+// channelCount returns f's channel count, treating the absent/zero value as
+// mono the same way normalize's own WAV handling does.
+func channelCount(f wav.AudioFormat) int {
+	if f.NumChannels == 0 {
+		return 1
+	}
+	return int(f.NumChannels)
+}
+
+// TrimSilence removes leading and trailing runs of frames whose samples all
+// stay at or below thresholdDBFS (a negative number such as the default
+// -60) from path's WAV data chunk, truncating the file and updating its
+// RIFF/data chunk sizes to match. It leaves the file untouched if there is
+// no leading or trailing silence to remove.
+func TrimSilence(path string, thresholdDBFS float64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := wav.ReadInfo(f)
+	if err != nil {
+		return err
+	}
+
+	threshold := math.Pow(10, thresholdDBFS/20)
+	sz := wav.SampleSize(info.Format)
+	channels := channelCount(info.Format)
+	frameSize := sz * channels
+	if frameSize == 0 {
+		return nil
+	}
+	frames := int(info.DataSize) / frameSize
+
+	isSilent := func(frame int) (bool, error) {
+		buf := make([]byte, frameSize)
+		if _, err := f.ReadAt(buf, info.DataOffset+int64(frame)*int64(frameSize)); err != nil {
+			return false, err
+		}
+		for c := 0; c < channels; c++ {
+			if math.Abs(wav.DecodeSample(buf[c*sz:(c+1)*sz], info.Format)) > threshold {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	lead := 0
+	for lead < frames {
+		silent, err := isSilent(lead)
+		if err != nil {
+			return err
+		}
+		if !silent {
+			break
+		}
+		lead++
+	}
+	trail := frames
+	for trail > lead {
+		silent, err := isSilent(trail - 1)
+		if err != nil {
+			return err
+		}
+		if !silent {
+			break
+		}
+		trail--
+	}
+	if lead == 0 && trail == frames {
+		return nil
+	}
+
+	kept := trail - lead
+	if kept > 0 {
+		buf := make([]byte, kept*frameSize)
+		if _, err := f.ReadAt(buf, info.DataOffset+int64(lead)*int64(frameSize)); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(buf, info.DataOffset); err != nil {
+			return err
+		}
+	}
+	return rewriteDataSize(f, info, int64(kept*frameSize))
+}
+
+// PadSilence adds leadMS milliseconds of silence before, and trailMS
+// milliseconds after, path's WAV samples. Either duration may be zero.
+func PadSilence(path string, leadMS, trailMS int) error {
+	if leadMS <= 0 && trailMS <= 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := wav.ReadInfo(f)
+	if err != nil {
+		return err
+	}
+
+	frameSize := wav.SampleSize(info.Format) * channelCount(info.Format)
+	leadBytes := int64(leadMS) * int64(info.Format.SampleRate) / 1000 * int64(frameSize)
+	trailBytes := int64(trailMS) * int64(info.Format.SampleRate) / 1000 * int64(frameSize)
+
+	data := make([]byte, info.DataSize)
+	if _, err := f.ReadAt(data, info.DataOffset); err != nil {
+		return err
+	}
+
+	// make already zero-fills the new leading and trailing silence.
+	padded := make([]byte, leadBytes+info.DataSize+trailBytes)
+	copy(padded[leadBytes:], data)
+
+	if _, err := f.WriteAt(padded, info.DataOffset); err != nil {
+		return err
+	}
+	return rewriteDataSize(f, info, int64(len(padded)))
+}
+
+// rewriteDataSize truncates/extends f to hold newDataSize bytes of samples
+// starting at info.DataOffset, and rewrites the data chunk's size field
+// (the 4 bytes right before DataOffset) and the RIFF chunk's overall size
+// field (at file offset 4) to match.
+func rewriteDataSize(f *os.File, info wav.Info, newDataSize int64) error {
+	if err := f.Truncate(info.DataOffset + newDataSize); err != nil {
+		return err
+	}
+
+	var sizeBuf [4]byte
+	binary.LittleEndian.PutUint32(sizeBuf[:], uint32(newDataSize))
+	if _, err := f.WriteAt(sizeBuf[:], info.DataOffset-4); err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint32(sizeBuf[:], uint32(info.DataOffset+newDataSize-8))
+	if _, err := f.WriteAt(sizeBuf[:], 4); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package wavedit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// writeWavFile writes a minimal mono 16 bit PCM WAV file at sampleRate
+// holding samples (one int16 per element) and returns its path.
+func writeWavFile(t *testing.T, dir string, samples []int16) string {
+	t.Helper()
+	const sampleRate = 44100
+
+	data := make([]byte, len(samples)*2)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(s))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+len(data)))
+	buf.WriteString("WAVE")
+
+	buf.WriteString("fmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))
+	binary.Write(&buf, binary.LittleEndian, uint16(1)) // PCM.
+	binary.Write(&buf, binary.LittleEndian, uint16(1)) // Mono.
+	binary.Write(&buf, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(&buf, binary.LittleEndian, uint32(sampleRate*2)) // Byte rate.
+	binary.Write(&buf, binary.LittleEndian, uint16(2))            // Block align.
+	binary.Write(&buf, binary.LittleEndian, uint16(16))           // Bits per sample.
+
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+
+	path := filepath.Join(dir, "test.wav")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readSamples re-reads path's data chunk as int16 samples, also returning
+// the RIFF and data chunk size fields so callers can check they were kept
+// in sync with the truncated/padded content.
+func readSamples(t *testing.T, path string) (samples []int16, riffSize, dataSize uint32) {
+	t.Helper()
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw[0:4]) != "RIFF" || string(raw[8:12]) != "WAVE" || string(raw[36:40]) != "data" {
+		t.Fatalf("%s is not the minimal WAV layout writeWavFile produces", path)
+	}
+	riffSize = binary.LittleEndian.Uint32(raw[4:8])
+	dataSize = binary.LittleEndian.Uint32(raw[40:44])
+	data := raw[44:]
+	if uint32(len(data)) != dataSize {
+		t.Fatalf("data chunk size %d does not match actual remaining bytes %d", dataSize, len(data))
+	}
+	samples = make([]int16, len(data)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(data[i*2:]))
+	}
+	return samples, riffSize, dataSize
+}
+
+func TestTrimSilenceAllSilent(t *testing.T) {
+	dir := t.TempDir()
+	path := writeWavFile(t, dir, make([]int16, 100))
+
+	if err := TrimSilence(path, -60); err != nil {
+		t.Fatal(err)
+	}
+
+	samples, riffSize, dataSize := readSamples(t, path)
+	if len(samples) != 0 {
+		t.Errorf("got %d samples left, want 0", len(samples))
+	}
+	if dataSize != 0 {
+		t.Errorf("data chunk size = %d, want 0", dataSize)
+	}
+	if riffSize != 36 {
+		t.Errorf("RIFF chunk size = %d, want 36 (header only)", riffSize)
+	}
+}
+
+func TestTrimSilenceNoSilence(t *testing.T) {
+	dir := t.TempDir()
+	loud := []int16{10000, -10000, 8000, -8000, 12000}
+	path := writeWavFile(t, dir, loud)
+
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TrimSilence(path, -60); err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(before, after) {
+		t.Error("TrimSilence modified a file with no leading or trailing silence")
+	}
+}
+
+func TestTrimSilenceAsymmetric(t *testing.T) {
+	dir := t.TempDir()
+	samples := append(append(make([]int16, 3), []int16{10000, -5000, 7777}...), make([]int16, 7)...)
+	path := writeWavFile(t, dir, samples)
+
+	if err := TrimSilence(path, -60); err != nil {
+		t.Fatal(err)
+	}
+
+	got, riffSize, dataSize := readSamples(t, path)
+	want := []int16{10000, -5000, 7777}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	if int(dataSize) != len(want)*2 {
+		t.Errorf("data chunk size = %d, want %d", dataSize, len(want)*2)
+	}
+	if int(riffSize) != 36+len(want)*2 {
+		t.Errorf("RIFF chunk size = %d, want %d", riffSize, 36+len(want)*2)
+	}
+}
+
+func TestPadSilence(t *testing.T) {
+	dir := t.TempDir()
+	samples := []int16{100, 200, 300}
+	path := writeWavFile(t, dir, samples)
+
+	const leadMS, trailMS = 10, 20
+	if err := PadSilence(path, leadMS, trailMS); err != nil {
+		t.Fatal(err)
+	}
+
+	got, riffSize, dataSize := readSamples(t, path)
+	const sampleRate = 44100
+	leadFrames := leadMS * sampleRate / 1000
+	trailFrames := trailMS * sampleRate / 1000
+	wantLen := leadFrames + len(samples) + trailFrames
+
+	if len(got) != wantLen {
+		t.Fatalf("got %d samples, want %d", len(got), wantLen)
+	}
+	for i := 0; i < leadFrames; i++ {
+		if got[i] != 0 {
+			t.Fatalf("sample %d in the lead padding = %d, want 0", i, got[i])
+		}
+	}
+	for i, s := range samples {
+		if got[leadFrames+i] != s {
+			t.Fatalf("original sample %d = %d, want %d", i, got[leadFrames+i], s)
+		}
+	}
+	for i := leadFrames + len(samples); i < wantLen; i++ {
+		if got[i] != 0 {
+			t.Fatalf("sample %d in the trail padding = %d, want 0", i, got[i])
+		}
+	}
+
+	if int(dataSize) != wantLen*2 {
+		t.Errorf("data chunk size = %d, want %d", dataSize, wantLen*2)
+	}
+	if int(riffSize) != 36+wantLen*2 {
+		t.Errorf("RIFF chunk size = %d, want %d", riffSize, 36+wantLen*2)
+	}
+}
+
+func TestPadSilenceZeroIsNoOp(t *testing.T) {
+	dir := t.TempDir()
+	path := writeWavFile(t, dir, []int16{1, 2, 3})
+
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PadSilence(path, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("PadSilence(path, 0, 0) modified the file")
+	}
+}